@@ -1,15 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
+	"mime"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/andybalholm/brotli"
+
 	"github.com/roman-mazur/design-practice-2-template/httptools"
 	"github.com/roman-mazur/design-practice-2-template/signal"
 )
@@ -25,6 +37,29 @@ var (
 	https      = flag.Bool("https", false, "whether backends support HTTPs")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+
+	compressEnabled   = flag.Bool("compress", false, "whether to compress compressible responses before returning them to the client")
+	compressMinBytes  = flag.Int("compress-min-bytes", 1024, "minimum uncompressed response size eligible for compression")
+	compressMaxBytes  = flag.Int("compress-max-bytes", 2<<20, "maximum uncompressed response size that may be buffered for compression; larger responses are streamed uncompressed")
+	compressEncodings = flag.String("compress-encodings", "gzip,br", "comma-separated list of encodings the balancer is allowed to use, in preference order; br is still picked over any other encoding the client accepts with the same q-value")
+
+	maxRetries        = flag.Int("max-retries", 2, "maximum number of additional backends to try when a forward fails")
+	retryBackoffBase  = flag.Duration("retry-backoff-base", 50*time.Millisecond, "base delay for retry backoff between backends")
+	retryBackoffCap   = flag.Duration("retry-backoff-cap", 500*time.Millisecond, "maximum delay for retry backoff between backends")
+	retryMaxBodyBytes = flag.Int("retry-max-body-bytes", 1<<20, "maximum request body size buffered to support retrying a forward against another backend; larger bodies are forwarded once with no retry")
+	breakerErrorRatio = flag.Float64("breaker-error-ratio", 0.5, "error ratio over the sampling window that trips a backend's circuit breaker")
+	breakerCooldown   = flag.Duration("breaker-cooldown", 10*time.Second, "how long an open circuit breaker stays open before allowing a probe")
+
+	healthInterval     = flag.Duration("health-interval", 10*time.Second, "how often to poll each backend's health endpoint")
+	healthPath         = flag.String("health-path", "/health", "path to request on each backend when checking its health")
+	healthyThreshold   = flag.Int("healthy-threshold", 2, "consecutive successful checks required before an unhealthy backend rejoins the pool")
+	unhealthyThreshold = flag.Int("unhealthy-threshold", 3, "consecutive failed checks required before a healthy backend is ejected from the pool")
+
+	drainTimeout    = flag.Duration("drain-timeout", 5*time.Second, "grace period after SIGTERM/SIGINT before the balancer stops accepting new requests")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests to finish before cancelling them and shutting down")
+
+	faultInject     = flag.Bool("fault-inject", false, "enable fault injection for testing unstable backends")
+	faultConfigPath = flag.String("fault-config", "", "path to a JSON file mapping backend address to injected-fault parameters")
 )
 
 var (
@@ -45,10 +80,375 @@ func scheme() string {
 	return "http"
 }
 
+// httpTransport is the RoundTripper used to reach backends. It's a package
+// variable so tests can swap in a fake transport.
+var httpTransport http.RoundTripper = http.DefaultTransport
+
+// breakerState is the state of a per-backend circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type breakerSample struct {
+	timestamp time.Time
+	failed    bool
+}
+
+// circuitBreaker tracks a rolling error rate for one backend and, once it
+// crosses breakerErrorRatio, opens to exclude that backend from selection
+// for breakerCooldown before allowing a single half-open probe through.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	openedAt time.Time
+	samples  []breakerSample
+	probing  bool
+}
+
+// permits is a side-effect-free check used when scanning backends for
+// selection: is this backend at least eligible to be tried right now.
+func (b *circuitBreaker) permits() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= *breakerCooldown && !b.probing
+	case breakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// beginAttempt claims the right to actually send a request to this backend,
+// transitioning an open breaker whose cool-down has elapsed into half-open
+// and admitting exactly one probe. Returns false if the breaker is open (or
+// another goroutine is already probing) and the attempt must be abandoned.
+func (b *circuitBreaker) beginAttempt() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(b.openedAt) < *breakerCooldown || b.probing {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	default: // breakerHalfOpen
+		return false
+	}
+}
+
+// recordResult reports the outcome of an attempt admitted by beginAttempt.
+func (b *circuitBreaker) recordResult(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.state = breakerOpen
+			b.openedAt = time.Now()
+		} else {
+			b.state = breakerClosed
+			b.samples = nil
+		}
+		return
+	}
+
+	now := time.Now()
+	b.samples = append(b.samples, breakerSample{timestamp: now, failed: failed})
+	cutoff := now.Add(-10 * time.Second)
+	fresh := make([]breakerSample, 0, len(b.samples))
+	for _, s := range b.samples {
+		if s.timestamp.After(cutoff) {
+			fresh = append(fresh, s)
+		}
+	}
+	b.samples = fresh
+
+	if b.state == breakerClosed && len(b.samples) >= 5 {
+		failures := 0
+		for _, s := range b.samples {
+			if s.failed {
+				failures++
+			}
+		}
+		if float64(failures)/float64(len(b.samples)) > *breakerErrorRatio {
+			b.state = breakerOpen
+			b.openedAt = now
+		}
+	}
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*circuitBreaker)
+)
+
+func getBreaker(dst string) *circuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[dst]
+	if !ok {
+		b = &circuitBreaker{}
+		breakers[dst] = b
+	}
+	return b
+}
+
+// isIdempotentMethod reports whether the HTTP method is safe to retry
+// against a different backend without the request having been buffered.
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryBackoff returns a full-jitter exponential backoff delay for the
+// given (zero-based) retry attempt, bounded by retryBackoffBase/Cap. A zero
+// retryBackoffBase disables backoff entirely rather than being treated as
+// an overflow and clamped up to retryBackoffCap.
+func retryBackoff(attempt int) time.Duration {
+	base, cap := *retryBackoffBase, *retryBackoffCap
+
+	backoff := cap
+	if base <= 0 {
+		backoff = 0
+	} else if attempt < 63 && base <= cap>>uint(attempt) {
+		backoff = base << uint(attempt)
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// selectServer returns the healthy, non-excluded backend with the least
+// traffic in its window, or "" if none are eligible.
+func selectServer(exclude map[string]bool) string {
+	var minTrafficServer string
+	minTraffic := int(^uint(0) >> 1) // set to max int value
+
+	mu.Lock()
+	for server, serverQueue := range traffic {
+		if exclude[server] {
+			continue
+		}
+		if state, ok := serverStates[server]; ok && !state.healthy {
+			continue
+		}
+		if !getBreaker(server).permits() {
+			continue
+		}
+		serverTraffic := 0
+		for _, st := range serverQueue {
+			serverTraffic += st.size
+		}
+		if serverTraffic < minTraffic {
+			minTraffic = serverTraffic
+			minTrafficServer = server
+		}
+	}
+	mu.Unlock()
+
+	return minTrafficServer
+}
+
+// allowedEncodings holds the encodings from --compress-encodings, in the
+// preference order the operator configured them, trimmed and lower-cased.
+// Populated once flags are parsed, in main().
+var allowedEncodings []string
+
+func parseAllowedEncodings(raw string) []string {
+	parts := strings.Split(raw, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// compressiblePrefixes and compressibleTypes describe the response content
+// types that are worth spending CPU on compressing.
+var compressiblePrefixes = []string{"text/"}
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	}
+	mediaType = strings.ToLower(mediaType)
+	if compressibleTypes[mediaType] {
+		return true
+	}
+	for _, prefix := range compressiblePrefixes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodingQuality is one entry of a parsed Accept-Encoding header.
+type encodingQuality struct {
+	name string
+	q    float64
+}
+
+// negotiateEncoding picks the best encoding present in both the client's
+// Accept-Encoding header and allowed, honoring q-values. When br and gzip
+// are equally acceptable, br wins. Returns "" when nothing matches, meaning
+// the response should be passed through uncompressed.
+func negotiateEncoding(acceptEncoding string, allowed []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	var candidates []encodingQuality
+	for _, token := range strings.Split(acceptEncoding, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+		name := token
+		q := 1.0
+		if idx := strings.Index(token, ";"); idx != -1 {
+			name = strings.TrimSpace(token[:idx])
+			for _, param := range strings.Split(token[idx+1:], ";") {
+				param = strings.TrimSpace(param)
+				if v, ok := strings.CutPrefix(param, "q="); ok {
+					if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+						q = parsed
+					}
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		candidates = append(candidates, encodingQuality{name: strings.ToLower(name), q: q})
+	}
+
+	preference := func(name string) int {
+		for i, enc := range allowed {
+			if enc == name {
+				return len(allowed) - i
+			}
+		}
+		return -1
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].q != candidates[j].q {
+			return candidates[i].q > candidates[j].q
+		}
+		// br is the better compressor, so it wins ties regardless of the
+		// order encodings were configured in --compress-encodings.
+		if candidates[i].name == "br" && candidates[j].name != "br" {
+			return true
+		}
+		if candidates[j].name == "br" && candidates[i].name != "br" {
+			return false
+		}
+		return preference(candidates[i].name) > preference(candidates[j].name)
+	})
+
+	for _, c := range candidates {
+		if c.name == "*" {
+			if len(allowed) > 0 {
+				return allowed[0]
+			}
+			continue
+		}
+		if preference(c.name) >= 0 {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// compressBody encodes body with the given encoding ("gzip" or "br").
+func compressBody(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch encoding {
+	case "gzip":
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "br":
+		w := brotli.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression encoding %q", encoding)
+	}
+	return buf.Bytes(), nil
+}
+
+// maybeCompress re-encodes bodyBytes with gzip or brotli when the client
+// accepts it, the upstream response is eligible, and --compress is set. It
+// returns the (possibly unchanged) body and the Content-Encoding to set, or
+// "" if the body was left untouched.
+func maybeCompress(r *http.Request, resp *http.Response, bodyBytes []byte) ([]byte, string) {
+	if !*compressEnabled {
+		return bodyBytes, ""
+	}
+	if resp.Header.Get("Content-Encoding") != "" {
+		return bodyBytes, ""
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return bodyBytes, ""
+	}
+	if len(bodyBytes) < *compressMinBytes {
+		return bodyBytes, ""
+	}
+	if !isCompressible(resp.Header.Get("Content-Type")) {
+		return bodyBytes, ""
+	}
+
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), allowedEncodings)
+	if encoding == "" {
+		return bodyBytes, ""
+	}
+
+	compressed, err := compressBody(encoding, bodyBytes)
+	if err != nil {
+		log.Printf("Failed to compress response with %s: %s", encoding, err)
+		return bodyBytes, ""
+	}
+	return compressed, encoding
+}
+
 func health(dst string) bool {
 	ctx, _ := context.WithTimeout(context.Background(), timeout)
 	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
+		fmt.Sprintf("%s://%s%s", scheme(), dst, *healthPath), nil)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return false
@@ -59,6 +459,50 @@ func health(dst string) bool {
 	return true
 }
 
+// serverState is the liveness record kept for one backend. A backend must
+// accumulate healthyThreshold consecutive successful checks before it's
+// considered recovered, and unhealthyThreshold consecutive failures before
+// it's ejected, so a single blip doesn't churn the pool. Guarded by mu.
+type serverState struct {
+	healthy              bool
+	lastCheck            time.Time
+	consecutiveFailures  int
+	consecutiveSuccesses int
+}
+
+var serverStates = make(map[string]*serverState)
+
+// updateServerHealth runs a health check against dst and updates its
+// serverState, flipping healthy only once the relevant threshold is met.
+func updateServerHealth(dst string) {
+	healthy := health(dst)
+
+	mu.Lock()
+	state, ok := serverStates[dst]
+	if !ok {
+		state = &serverState{healthy: true}
+		serverStates[dst] = state
+	}
+	state.lastCheck = time.Now()
+
+	if healthy {
+		state.consecutiveSuccesses++
+		state.consecutiveFailures = 0
+		if !state.healthy && state.consecutiveSuccesses >= *healthyThreshold {
+			state.healthy = true
+			log.Printf("%s recovered after %d consecutive successful checks, back in rotation", dst, state.consecutiveSuccesses)
+		}
+	} else {
+		state.consecutiveFailures++
+		state.consecutiveSuccesses = 0
+		if state.healthy && state.consecutiveFailures >= *unhealthyThreshold {
+			state.healthy = false
+			log.Printf("%s ejected from rotation after %d consecutive failed checks", dst, state.consecutiveFailures)
+		}
+	}
+	mu.Unlock()
+}
+
 func incrementTraffic(dst string, size int) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -94,58 +538,503 @@ func reduceTraffic() {
 	}
 }
 
-func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
+// jsonDuration lets fault config files spell out latencies as strings
+// ("150ms") instead of raw nanosecond counts.
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
+
+// faultSpec describes the fault to inject for one backend address: roll
+// against FailureProbability and, if it hits, sleep a random duration in
+// [MinLatency, MaxLatency] and/or short-circuit with HTTPStatusOverride
+// (zero meaning "no override", i.e. just the latency).
+type faultSpec struct {
+	FailureProbability float64      `json:"failure_probability"`
+	MinLatency         jsonDuration `json:"min_latency"`
+	MaxLatency         jsonDuration `json:"max_latency"`
+	HTTPStatusOverride int          `json:"http_status_override"`
+}
+
+var (
+	faultsMu sync.Mutex
+	faults   = make(map[string]faultSpec)
+)
+
+// loadFaultConfig reads the backend -> faultSpec map from a JSON file. An
+// empty path is treated as "no faults configured".
+func loadFaultConfig(path string) (map[string]faultSpec, error) {
+	if path == "" {
+		return map[string]faultSpec{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := make(map[string]faultSpec)
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func setFaults(cfg map[string]faultSpec) {
+	faultsMu.Lock()
+	faults = cfg
+	faultsMu.Unlock()
+}
+
+func getFault(dst string) (faultSpec, bool) {
+	faultsMu.Lock()
+	defer faultsMu.Unlock()
+	spec, ok := faults[dst]
+	return spec, ok
+}
+
+// injectFault rolls the configured fault for dst, if any, and reports
+// whether the caller should skip the real backend call entirely and use
+// the returned response instead.
+func injectFault(dst string, r *http.Request) (*http.Response, bool) {
+	spec, ok := getFault(dst)
+	if !ok || spec.FailureProbability <= 0 || rand.Float64() >= spec.FailureProbability {
+		return nil, false
+	}
+
+	if spec.MaxLatency > 0 {
+		lo, hi := int64(spec.MinLatency), int64(spec.MaxLatency)
+		if hi < lo {
+			hi = lo
+		}
+		delay := lo
+		if hi > lo {
+			delay += rand.Int63n(hi - lo + 1)
+		}
+		select {
+		case <-time.After(time.Duration(delay)):
+		case <-r.Context().Done():
+		}
+	}
+
+	if spec.HTTPStatusOverride == 0 {
+		return nil, false
+	}
+	return &http.Response{
+		StatusCode: spec.HTTPStatusOverride,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}, true
+}
+
+// errBreakerOpen is returned by attemptForward when the backend's circuit
+// breaker refuses the attempt outright, without a network call being made.
+var errBreakerOpen = fmt.Errorf("circuit breaker open")
+
+// attemptForward sends one request to dst and returns its response with the
+// body still open. The status code (available without reading the body) is
+// enough to record the circuit-breaker outcome and decide whether a retry
+// is warranted, so the caller is free to either stream resp.Body to a
+// client via writeForwardResponse or close it and retry another backend.
+func attemptForward(dst string, r *http.Request) (*http.Response, error) {
+	breaker := getBreaker(dst)
+	if !breaker.beginAttempt() {
+		return nil, errBreakerOpen
+	}
+
+	if *faultInject {
+		if resp, injected := injectFault(dst, r); injected {
+			breaker.recordResult(resp.StatusCode >= http.StatusInternalServerError)
+			return resp, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
 	fwdRequest := r.Clone(ctx)
 	fwdRequest.RequestURI = ""
 	fwdRequest.URL.Host = dst
 	fwdRequest.URL.Scheme = scheme()
 	fwdRequest.Host = dst
 
-	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		defer resp.Body.Close()
+	client := &http.Client{Transport: httpTransport}
+	resp, err := client.Do(fwdRequest)
+	if err != nil {
+		cancel()
+		breaker.recordResult(true)
+		return nil, err
+	}
+
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	breaker.recordResult(resp.StatusCode >= http.StatusInternalServerError)
+	return resp, nil
+}
+
+// cancelOnCloseBody cancels the forwarding request's context once the
+// caller is done reading its response body, since attemptForward can't
+// defer that cancellation itself without cutting the stream short.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
 
-		// Read the response body into a byte slice
-		bodyBytes, err := io.ReadAll(resp.Body)
+// byteCounter is an io.Writer that only counts the bytes written through
+// it, for measuring a streamed response without buffering it.
+type byteCounter struct{ n int }
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += len(p)
+	return len(p), nil
+}
+
+// streamFlushBytes is how often a streamed response is flushed to the
+// client absent a more specific signal (e.g. an SSE newline).
+const streamFlushBytes = 4096
+
+// flushingWriter wraps a ResponseWriter and flushes it periodically while
+// streaming, so clients start receiving bytes before the upstream response
+// completes, and promptly for text/event-stream so events aren't delayed.
+type flushingWriter struct {
+	rw         http.ResponseWriter
+	flusher    http.Flusher
+	sse        bool
+	sinceFlush int
+}
+
+func newFlushingWriter(rw http.ResponseWriter, contentType string) *flushingWriter {
+	flusher, _ := rw.(http.Flusher)
+	return &flushingWriter{rw: rw, flusher: flusher, sse: strings.HasPrefix(contentType, "text/event-stream")}
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	n, err := f.rw.Write(p)
+	if err != nil || f.flusher == nil {
+		return n, err
+	}
+	f.sinceFlush += n
+	if (f.sse && bytes.IndexByte(p[:n], '\n') != -1) || f.sinceFlush >= streamFlushBytes {
+		f.flusher.Flush()
+		f.sinceFlush = 0
+	}
+	return n, nil
+}
+
+// isCompressionCandidate is the cheap, body-size-independent half of
+// maybeCompress's eligibility check. It lets writeForwardResponse decide
+// whether a response is worth buffering for compression before it has
+// read (and so knows the size of) the body.
+func isCompressionCandidate(r *http.Request, resp *http.Response) bool {
+	if !*compressEnabled {
+		return false
+	}
+	if resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	if !isCompressible(resp.Header.Get("Content-Type")) {
+		return false
+	}
+	return negotiateEncoding(r.Header.Get("Accept-Encoding"), allowedEncodings) != ""
+}
+
+// writeForwardResponse copies an upstream response (as obtained from
+// attemptForward) onto rw and closes its body. Compression candidates are
+// buffered so they can be re-encoded; everything else is streamed straight
+// through, counting bytes as they're written for traffic accounting.
+func writeForwardResponse(rw http.ResponseWriter, r *http.Request, dst string, resp *http.Response) {
+	defer resp.Body.Close()
+
+	for k, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	if *traceEnabled {
+		rw.Header().Set("lb-from", dst)
+	}
+	log.Println("fwd", resp.StatusCode, r.URL)
+
+	if isCompressionCandidate(r, resp) {
+		// Buffer at most compressMaxBytes+1: large enough to tell whether the
+		// body fits under the ceiling, small enough that a multi-MB response
+		// can't be read into memory just because its Content-Type happens to
+		// be compressible.
+		limit := int64(*compressMaxBytes)
+		bodyBytes, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
 		if err != nil {
-			log.Printf("Failed to read response body: %s", err)
-			rw.WriteHeader(http.StatusInternalServerError)
-			return err
+			log.Printf("Failed to read response body from %s: %s", dst, err)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
 		}
 
-		// Increment the traffic count by the size of the response body
-		incrementTraffic(dst, len(bodyBytes))
+		if int64(len(bodyBytes)) <= limit {
+			// Increment the traffic count by the pre-compression size of the
+			// response body, so balancing isn't skewed by encoding efficiency.
+			incrementTraffic(dst, len(bodyBytes))
 
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
+			bodyBytes, encoding := maybeCompress(r, resp, bodyBytes)
+			if encoding != "" {
+				rw.Header().Set("Content-Encoding", encoding)
+				rw.Header().Set("Content-Length", strconv.Itoa(len(bodyBytes)))
+				vary := rw.Header().Get("Vary")
+				if !strings.Contains(vary, "Accept-Encoding") {
+					if vary == "" {
+						rw.Header().Set("Vary", "Accept-Encoding")
+					} else {
+						rw.Header().Set("Vary", vary+", Accept-Encoding")
+					}
+				}
 			}
+			rw.WriteHeader(resp.StatusCode)
+			if _, err := rw.Write(bodyBytes); err != nil {
+				log.Printf("Failed to write response: %s", err)
+			}
+			return
 		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst)
-		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
+
+		// Body exceeds compressMaxBytes: fall through to streaming instead
+		// of buffering it in full. The prefix already read has to be
+		// stitched back in front of the rest of the body.
+		rw.Header().Del("Content-Length")
 		rw.WriteHeader(resp.StatusCode)
-		_, err = rw.Write(bodyBytes) // Write the body bytes to the ResponseWriter
-		if err != nil {
-			log.Printf("Failed to write response: %s", err)
+		counter := &byteCounter{n: len(bodyBytes)}
+		fw := newFlushingWriter(rw, resp.Header.Get("Content-Type"))
+		if _, err := fw.Write(bodyBytes); err != nil {
+			log.Printf("Failed to stream response from %s: %s", dst, err)
 		}
-		return nil
-	} else {
+		if _, err := io.Copy(fw, io.TeeReader(resp.Body, counter)); err != nil {
+			log.Printf("Failed to stream response from %s: %s", dst, err)
+		}
+		if fw.flusher != nil {
+			fw.flusher.Flush()
+		}
+		incrementTraffic(dst, counter.n)
+		return
+	}
+
+	rw.WriteHeader(resp.StatusCode)
+	counter := &byteCounter{}
+	fw := newFlushingWriter(rw, resp.Header.Get("Content-Type"))
+	if _, err := io.Copy(fw, io.TeeReader(resp.Body, counter)); err != nil {
+		log.Printf("Failed to stream response from %s: %s", dst, err)
+	}
+	if fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+	incrementTraffic(dst, counter.n)
+}
+
+// forward sends a single request to dst and writes the result (or a 503)
+// to rw.
+func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
+	resp, err := attemptForward(dst, r)
+	if err != nil {
 		log.Printf("Failed to get response from %s: %s", dst, err)
 		rw.WriteHeader(http.StatusServiceUnavailable)
 		return err
 	}
+
+	writeForwardResponse(rw, r, dst, resp)
+	return nil
+}
+
+// forwardWithRetry selects a backend and forwards the request, retrying
+// against other backends on a network error or 5xx response when the
+// request is idempotent or its body could be buffered for replay.
+func forwardWithRetry(rw http.ResponseWriter, r *http.Request) {
+	var bodyBytes []byte
+	bodyBuffered := true
+	oversizedBody := false
+	if r.Body != nil {
+		limit := int64(*retryMaxBodyBytes)
+		b, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			r.Body.Close()
+			bodyBuffered = false
+		} else if int64(len(b)) > limit {
+			// Too large to buffer for replay: stitch the prefix already
+			// read back onto the stream and forward it once, uncapped,
+			// with no retry support.
+			oversizedBody = true
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(b), r.Body))
+		} else {
+			r.Body.Close()
+			bodyBytes = b
+		}
+	}
+	retryable := !oversizedBody && (isIdempotentMethod(r.Method) || bodyBuffered)
+
+	maxAttempts := 1
+	if retryable {
+		maxAttempts = *maxRetries + 1
+	}
+
+	tried := make(map[string]bool)
+	var lastDst string
+	var lastResp *http.Response
+	var lastErr error
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		dst := selectServer(tried)
+		if dst == "" {
+			break
+		}
+		tried[dst] = true
+		lastDst = dst
+
+		if r.Body != nil && !oversizedBody {
+			r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		}
+
+		resp, err := attemptForward(dst, r)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			writeForwardResponse(rw, r, dst, resp)
+			return
+		}
+
+		if lastResp != nil {
+			lastResp.Body.Close()
+		}
+		lastErr, lastResp = err, resp
+
+		if !retryable || attempt == maxAttempts-1 {
+			break
+		}
+		time.Sleep(retryBackoff(attempt))
+	}
+
+	if lastResp != nil {
+		writeForwardResponse(rw, r, lastDst, lastResp)
+		return
+	}
+	log.Printf("Failed to get response from %s: %v", lastDst, lastErr)
+	rw.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// Shutdown state. shuttingDown flips the frontend's own /health endpoint to
+// unhealthy as soon as a termination signal arrives, so an upstream LB or
+// orchestrator stops routing new traffic in. draining flips once
+// drainTimeout has elapsed, after which freshly arrived requests are
+// rejected outright instead of being forwarded. inFlight tracks forwards
+// that are still running so shutdown can wait for them; shutdownSignal is
+// closed once to cancel any forwards still in flight past shutdownTimeout.
+var (
+	shuttingDown   atomic.Bool
+	draining       atomic.Bool
+	inFlight       sync.WaitGroup
+	shutdownSignal = make(chan struct{})
+)
+
+// frontendHealthHandler is the balancer's own /health endpoint, used by an
+// upstream load balancer or orchestrator to know when to stop sending us
+// traffic during shutdown.
+func frontendHealthHandler(rw http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(rw, "shutting down")
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintln(rw, "OK")
+}
+
+// lbFaultsHandler reports the currently configured fault map on GET and
+// reloads it from --fault-config on POST, so integration tests can flip
+// backend misbehavior on without restarting the balancer.
+func lbFaultsHandler(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		faultsMu.Lock()
+		defer faultsMu.Unlock()
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(faults); err != nil {
+			log.Printf("Failed to encode /lb/faults response: %s", err)
+		}
+	case http.MethodPost:
+		cfg, err := loadFaultConfig(*faultConfigPath)
+		if err != nil {
+			log.Printf("Failed to reload fault config from %s: %s", *faultConfigPath, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		setFaults(cfg)
+		rw.WriteHeader(http.StatusOK)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// lbStatusEntry is the JSON shape of one backend in the /lb/status response.
+type lbStatusEntry struct {
+	Server               string    `json:"server"`
+	Healthy              bool      `json:"healthy"`
+	ConsecutiveFailures  int       `json:"consecutiveFailures"`
+	ConsecutiveSuccesses int       `json:"consecutiveSuccesses"`
+	LastCheck            time.Time `json:"lastCheck"`
+	Traffic              int       `json:"traffic"`
+}
+
+// lbStatusHandler reports each backend's health and current traffic window,
+// replacing the old log-every-10s pattern with state an operator can poll.
+func lbStatusHandler(rw http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	entries := make([]lbStatusEntry, 0, len(serversPool))
+	for _, server := range serversPool {
+		trafficTotal := 0
+		for _, st := range traffic[server] {
+			trafficTotal += st.size
+		}
+		entry := lbStatusEntry{Server: server, Traffic: trafficTotal}
+		if state, ok := serverStates[server]; ok {
+			entry.Healthy = state.healthy
+			entry.ConsecutiveFailures = state.consecutiveFailures
+			entry.ConsecutiveSuccesses = state.consecutiveSuccesses
+			entry.LastCheck = state.lastCheck
+		}
+		entries = append(entries, entry)
+	}
+	mu.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(entries); err != nil {
+		log.Printf("Failed to encode /lb/status response: %s", err)
+	}
 }
 
 func main() {
 	flag.Parse()
 
-	// Initialize traffic for each server as empty queue.
+	allowedEncodings = parseAllowedEncodings(*compressEncodings)
+
+	if *faultInject {
+		cfg, err := loadFaultConfig(*faultConfigPath)
+		if err != nil {
+			log.Fatalf("Failed to load fault config from %s: %s", *faultConfigPath, err)
+		}
+		setFaults(cfg)
+	}
+
+	// Initialize traffic and health state for each server.
 	mu.Lock()
 	for _, server := range serversPool {
 		traffic[server] = make([]sizeTimestamp, 0)
+		serverStates[server] = &serverState{healthy: true}
 	}
 	mu.Unlock()
 
@@ -155,47 +1044,77 @@ func main() {
 	for _, server := range serversPool {
 		server := server
 		go func() {
-			for range time.Tick(10 * time.Second) {
-				healthy := health(server)
-				mu.Lock()
-				var load int
-				for _, st := range traffic[server] {
-					load += st.size
-				}
-				mu.Unlock()
-				log.Printf("%s healthy: %t, load: %d", server, healthy, load)
+			for range time.Tick(*healthInterval) {
+				updateServerHealth(server)
 			}
 		}()
 	}
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		var minTrafficServer string
-		minTraffic := int(^uint(0) >> 1) // set to max int value
-
-		mu.Lock()
-		for server, serverQueue := range traffic {
-			serverTraffic := 0
-			for _, st := range serverQueue {
-				serverTraffic += st.size
-			}
-			if serverTraffic < minTraffic {
-				minTraffic = serverTraffic
-				minTrafficServer = server
-			}
-		}
-		mu.Unlock()
-
-		if minTrafficServer == "" {
-			log.Println("No servers available")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", frontendHealthHandler)
+	mux.HandleFunc("/lb/status", lbStatusHandler)
+	mux.HandleFunc("/lb/faults", lbFaultsHandler)
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
 			rw.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 
-		forward(minTrafficServer, rw, r)
-	}))
+		inFlight.Add(1)
+		defer inFlight.Done()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-shutdownSignal:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		forwardWithRetry(rw, r.WithContext(ctx))
+	})
+	frontend := httptools.CreateServer(*port, mux)
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
 	frontend.Start()
 	signal.WaitForTerminationSignal()
+
+	shutdown(frontend)
+}
+
+// shutdown runs the drain pipeline once a termination signal has been
+// received: fail /health immediately, stop admitting new requests after
+// drainTimeout, wait for in-flight forwards (cancelling any still running
+// past shutdownTimeout), then shut the frontend server down.
+func shutdown(frontend *httptools.Server) {
+	log.Println("Received termination signal, failing health checks and draining connections...")
+	shuttingDown.Store(true)
+
+	time.Sleep(*drainTimeout)
+	draining.Store(true)
+	log.Println("Drain period elapsed, no longer accepting new requests")
+
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("All in-flight requests completed")
+	case <-time.After(*shutdownTimeout):
+		log.Println("Shutdown timeout exceeded, cancelling remaining in-flight requests")
+		close(shutdownSignal)
+		<-done
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := frontend.Shutdown(ctx); err != nil {
+		log.Printf("Error during shutdown: %s", err)
+	}
 }
@@ -1,14 +1,351 @@
 package main
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// fakeRoundTripper lets tests script upstream responses per server without
+// a real network call, for exercising the retry/circuit-breaker state
+// machine deterministically.
+type fakeRoundTripper struct {
+	responses map[string][]roundTripResult
+	calls     map[string]int
+}
+
+type roundTripResult struct {
+	status int
+	err    error
+}
+
+func (f *fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+	host := req.URL.Host
+	results := f.responses[host]
+	idx := f.calls[host]
+	f.calls[host]++
+	if idx >= len(results) {
+		idx = len(results) - 1
+	}
+	result := results[idx]
+	if result.err != nil {
+		return nil, result.err
+	}
+	return &http.Response{
+		StatusCode: result.status,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("body")),
+		Request:    req,
+	}, nil
+}
+
+// roundTripperFunc adapts a plain function to http.RoundTripper, for tests
+// that need to inspect a request rather than just script a response.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// resetBreakers clears global breaker state between tests.
+func resetBreakers() {
+	breakersMu.Lock()
+	breakers = make(map[string]*circuitBreaker)
+	breakersMu.Unlock()
+}
+
+// TestCircuitBreakerOpensAfterErrorRatio tests that a breaker trips once
+// the configured error ratio is exceeded over enough samples.
+func TestCircuitBreakerOpensAfterErrorRatio(t *testing.T) {
+	b := &circuitBreaker{}
+	for i := 0; i < 3; i++ {
+		b.recordResult(true)
+	}
+	for i := 0; i < 2; i++ {
+		b.recordResult(false)
+	}
+	assert.False(t, b.permits(), "breaker should have opened at >50%% failures with >=5 samples")
+}
+
+// TestCircuitBreakerHalfOpenRecovers tests the open -> half-open -> closed
+// transition once the cool-down elapses and a probe succeeds.
+func TestCircuitBreakerHalfOpenRecovers(t *testing.T) {
+	b := &circuitBreaker{state: breakerOpen, openedAt: time.Now().Add(-time.Hour)}
+
+	assert.True(t, b.beginAttempt(), "cooled-down breaker should admit a probe")
+	assert.False(t, b.beginAttempt(), "a second concurrent probe must be refused")
+
+	b.recordResult(false)
+	assert.True(t, b.permits(), "a successful probe should close the breaker")
+}
+
+// TestCircuitBreakerHalfOpenReopensOnFailure tests that a failed probe
+// reopens the breaker rather than closing it.
+func TestCircuitBreakerHalfOpenReopensOnFailure(t *testing.T) {
+	b := &circuitBreaker{state: breakerOpen, openedAt: time.Now().Add(-time.Hour)}
+	assert.True(t, b.beginAttempt())
+	b.recordResult(true)
+	assert.False(t, b.permits(), "a failed probe should reopen the breaker")
+}
+
+// TestUpdateServerHealthEjectsAfterThreshold tests that a backend needs
+// unhealthyThreshold consecutive failures to be ejected from the pool.
+func TestUpdateServerHealthEjectsAfterThreshold(t *testing.T) {
+	const dst = "flaky-server:8080"
+	mu.Lock()
+	delete(serverStates, dst)
+	mu.Unlock()
+
+	oldUnhealthy, oldHealthy := *unhealthyThreshold, *healthyThreshold
+	*unhealthyThreshold, *healthyThreshold = 3, 2
+	defer func() { *unhealthyThreshold, *healthyThreshold = oldUnhealthy, oldHealthy }()
+
+	state := func() *serverState {
+		mu.Lock()
+		defer mu.Unlock()
+		return serverStates[dst]
+	}
+
+	// health() will fail since dst doesn't exist; two failures aren't
+	// enough to eject.
+	updateServerHealth(dst)
+	updateServerHealth(dst)
+	assert.True(t, state().healthy, "should still be healthy before reaching unhealthyThreshold")
+
+	// Third consecutive failure ejects it.
+	updateServerHealth(dst)
+	assert.False(t, state().healthy)
+	assert.Equal(t, 3, state().consecutiveFailures)
+}
+
+// TestSelectServerSkipsUnhealthy tests that selectServer excludes backends
+// whose serverState is unhealthy, even if they have the least traffic.
+func TestSelectServerSkipsUnhealthy(t *testing.T) {
+	mu.Lock()
+	for _, server := range serversPool {
+		traffic[server] = make([]sizeTimestamp, 0)
+		serverStates[server] = &serverState{healthy: true}
+	}
+	serverStates["server1:8080"].healthy = false
+	mu.Unlock()
+	defer resetBreakers()
+	resetBreakers()
+
+	dst := selectServer(map[string]bool{})
+	assert.NotEqual(t, "server1:8080", dst)
+}
+
+// TestRetryBackoffZeroBaseDisablesBackoff tests that a zero
+// retry-backoff-base means no delay, rather than being mistaken for
+// overflow and clamped up to retry-backoff-cap.
+func TestRetryBackoffZeroBaseDisablesBackoff(t *testing.T) {
+	oldBase, oldCap := *retryBackoffBase, *retryBackoffCap
+	defer func() { *retryBackoffBase, *retryBackoffCap = oldBase, oldCap }()
+	*retryBackoffBase = 0
+	*retryBackoffCap = 500 * time.Millisecond
+
+	assert.Equal(t, time.Duration(0), retryBackoff(0))
+	assert.Equal(t, time.Duration(0), retryBackoff(5))
+}
+
+// TestRetryBackoffClampsOnOverflow tests that a large attempt count still
+// clamps to retry-backoff-cap instead of overflowing.
+func TestRetryBackoffClampsOnOverflow(t *testing.T) {
+	oldBase, oldCap := *retryBackoffBase, *retryBackoffCap
+	defer func() { *retryBackoffBase, *retryBackoffCap = oldBase, oldCap }()
+	*retryBackoffBase = 50 * time.Millisecond
+	*retryBackoffCap = 500 * time.Millisecond
+
+	assert.LessOrEqual(t, retryBackoff(62), *retryBackoffCap)
+}
+
+// TestForwardWithRetryFailsOverToHealthyBackend tests that a network error
+// on the first selected backend causes a retry against another backend.
+func TestForwardWithRetryFailsOverToHealthyBackend(t *testing.T) {
+	resetBreakers()
+	oldTransport := httpTransport
+	defer func() { httpTransport = oldTransport }()
+
+	httpTransport = &fakeRoundTripper{
+		responses: map[string][]roundTripResult{
+			"server1:8080": {{err: assert.AnError}},
+			"server2:8080": {{status: http.StatusOK}},
+			"server3:8080": {{status: http.StatusOK}},
+		},
+	}
+
+	mu.Lock()
+	for _, server := range serversPool {
+		traffic[server] = make([]sizeTimestamp, 0)
+	}
+	mu.Unlock()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	forwardWithRetry(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+// TestForwardWithRetryGivesUpAfterMaxRetries tests that once every backend
+// is exhausted, the balancer reports the last failure instead of hanging.
+func TestForwardWithRetryGivesUpAfterMaxRetries(t *testing.T) {
+	resetBreakers()
+	oldTransport := httpTransport
+	defer func() { httpTransport = oldTransport }()
+
+	httpTransport = &fakeRoundTripper{
+		responses: map[string][]roundTripResult{
+			"server1:8080": {{err: assert.AnError}},
+			"server2:8080": {{err: assert.AnError}},
+			"server3:8080": {{err: assert.AnError}},
+		},
+	}
+
+	mu.Lock()
+	for _, server := range serversPool {
+		traffic[server] = make([]sizeTimestamp, 0)
+	}
+	mu.Unlock()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	forwardWithRetry(rr, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+// TestForwardWithRetrySkipsRetryOnOversizedBody tests that a request body
+// larger than retry-max-body-bytes is forwarded once, with its content
+// intact, instead of being buffered in full to support a retry.
+func TestForwardWithRetrySkipsRetryOnOversizedBody(t *testing.T) {
+	resetBreakers()
+	oldTransport, oldMax := httpTransport, *retryMaxBodyBytes
+	defer func() { httpTransport = oldTransport; *retryMaxBodyBytes = oldMax }()
+	*retryMaxBodyBytes = 4
+
+	var gotBody []byte
+	httpTransport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotBody, _ = io.ReadAll(req.Body)
+		return nil, assert.AnError
+	})
+
+	mu.Lock()
+	for _, server := range serversPool {
+		traffic[server] = make([]sizeTimestamp, 0)
+	}
+	mu.Unlock()
+
+	body := strings.Repeat("x", 1024)
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	forwardWithRetry(rr, req)
+
+	// A single attempt was made (no failover across backends), but the
+	// full, un-truncated body reached the backend that was tried.
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, body, string(gotBody))
+}
+
+// TestNegotiateEncoding tests picking an encoding out of Accept-Encoding.
+func TestNegotiateEncoding(t *testing.T) {
+	allowed := []string{"gzip", "br"}
+
+	assert.Equal(t, "br", negotiateEncoding("gzip, br", allowed))
+	assert.Equal(t, "br", negotiateEncoding("gzip;q=0.8, br;q=0.8", allowed))
+	assert.Equal(t, "gzip", negotiateEncoding("gzip;q=1.0, br;q=0.5", allowed))
+	assert.Equal(t, "gzip", negotiateEncoding("gzip", allowed))
+	assert.Equal(t, "", negotiateEncoding("identity", allowed))
+	assert.Equal(t, "", negotiateEncoding("", allowed))
+	assert.Equal(t, "gzip", negotiateEncoding("deflate, gzip;q=0.5", allowed))
+}
+
+// TestIsCompressible tests the content-type allowlist used to decide
+// whether a response is worth compressing.
+func TestIsCompressible(t *testing.T) {
+	assert.True(t, isCompressible("text/html; charset=utf-8"))
+	assert.True(t, isCompressible("application/json"))
+	assert.True(t, isCompressible("image/svg+xml"))
+	assert.False(t, isCompressible("image/png"))
+	assert.False(t, isCompressible("application/octet-stream"))
+}
+
+// TestMaybeCompressThreshold tests that responses under --compress-min-bytes
+// are passed through untouched.
+func TestMaybeCompressThreshold(t *testing.T) {
+	oldEnabled, oldMin := *compressEnabled, *compressMinBytes
+	*compressEnabled = true
+	*compressMinBytes = 1024
+	defer func() { *compressEnabled, *compressMinBytes = oldEnabled, oldMin }()
+	allowedEncodings = []string{"gzip", "br"}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+
+	resp := &http.Response{Header: http.Header{"Content-Type": []string{"text/plain"}}}
+	body := []byte("too small to bother compressing")
+
+	out, encoding := maybeCompress(req, resp, body)
+	assert.Equal(t, "", encoding)
+	assert.Equal(t, body, out)
+}
+
+// TestMaybeCompressPassThrough tests that an already-encoded upstream
+// response and a no-transform response are both left untouched.
+func TestMaybeCompressPassThrough(t *testing.T) {
+	oldEnabled, oldMin := *compressEnabled, *compressMinBytes
+	*compressEnabled = true
+	*compressMinBytes = 0
+	defer func() { *compressEnabled, *compressMinBytes = oldEnabled, oldMin }()
+	allowedEncodings = []string{"gzip", "br"}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	body := []byte("some body content")
+
+	alreadyEncoded := &http.Response{Header: http.Header{
+		"Content-Type":     []string{"text/plain"},
+		"Content-Encoding": []string{"gzip"},
+	}}
+	_, encoding := maybeCompress(req, alreadyEncoded, body)
+	assert.Equal(t, "", encoding)
+
+	noTransform := &http.Response{Header: http.Header{
+		"Content-Type":  []string{"text/plain"},
+		"Cache-Control": []string{"no-transform"},
+	}}
+	_, encoding = maybeCompress(req, noTransform, body)
+	assert.Equal(t, "", encoding)
+}
+
+// TestMaybeCompressSelectsBrotli tests that an eligible response above the
+// size threshold gets brotli-compressed when the client accepts it.
+func TestMaybeCompressSelectsBrotli(t *testing.T) {
+	oldEnabled, oldMin := *compressEnabled, *compressMinBytes
+	*compressEnabled = true
+	*compressMinBytes = 4
+	defer func() { *compressEnabled, *compressMinBytes = oldEnabled, oldMin }()
+	allowedEncodings = []string{"gzip", "br"}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+
+	resp := &http.Response{Header: http.Header{"Content-Type": []string{"application/json"}}}
+	body := []byte(`{"hello":"world"}`)
+
+	out, encoding := maybeCompress(req, resp, body)
+	assert.Equal(t, "br", encoding)
+	assert.NotEqual(t, body, out)
+}
+
 // TestHealthCheck tests the health check function
 func TestHealthCheck(t *testing.T) {
 	// If a server is not available, the health check should return false.
@@ -127,3 +464,189 @@ func TestBalancer(t *testing.T) {
 		assert.Equal(t, minTraffic, minServerTraffic)
 	})
 }
+
+// TestInjectFaultShortCircuits tests that a fault configured with
+// probability 1.0 and a status override skips the real backend call.
+func TestInjectFaultShortCircuits(t *testing.T) {
+	defer setFaults(map[string]faultSpec{})
+	setFaults(map[string]faultSpec{
+		"flaky:8080": {FailureProbability: 1, HTTPStatusOverride: http.StatusTeapot},
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, injected := injectFault("flaky:8080", req)
+	assert.True(t, injected)
+	assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+}
+
+// TestInjectFaultLatencyOnlyDoesNotShortCircuit tests that a fault with no
+// status override just adds latency and lets the real call proceed.
+func TestInjectFaultLatencyOnlyDoesNotShortCircuit(t *testing.T) {
+	defer setFaults(map[string]faultSpec{})
+	setFaults(map[string]faultSpec{
+		"flaky:8080": {FailureProbability: 1, MinLatency: jsonDuration(time.Millisecond), MaxLatency: jsonDuration(2 * time.Millisecond)},
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	start := time.Now()
+	resp, injected := injectFault("flaky:8080", req)
+	assert.False(t, injected)
+	assert.Nil(t, resp)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond)
+}
+
+// TestInjectFaultSkipsUnconfiguredBackend tests that a backend with no
+// fault entry is never affected.
+func TestInjectFaultSkipsUnconfiguredBackend(t *testing.T) {
+	defer setFaults(map[string]faultSpec{})
+	setFaults(map[string]faultSpec{})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, injected := injectFault("server1:8080", req)
+	assert.False(t, injected)
+	assert.Nil(t, resp)
+}
+
+// TestForwardWithRetryRecoversFromFlakyBackend tests that forwardWithRetry
+// retries past a backend whose injected fault short-circuits its requests.
+func TestForwardWithRetryRecoversFromFlakyBackend(t *testing.T) {
+	resetBreakers()
+	oldTransport := httpTransport
+	defer func() { httpTransport = oldTransport }()
+	defer setFaults(map[string]faultSpec{})
+
+	*faultInject = true
+	defer func() { *faultInject = false }()
+
+	setFaults(map[string]faultSpec{
+		"server1:8080": {FailureProbability: 1, HTTPStatusOverride: http.StatusServiceUnavailable},
+	})
+	httpTransport = &fakeRoundTripper{
+		responses: map[string][]roundTripResult{
+			"server2:8080": {{status: http.StatusOK}},
+			"server3:8080": {{status: http.StatusOK}},
+		},
+	}
+
+	mu.Lock()
+	for _, server := range serversPool {
+		traffic[server] = make([]sizeTimestamp, 0)
+	}
+	mu.Unlock()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	forwardWithRetry(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+// TestFrontendHealthHandler tests that the balancer's own /health endpoint
+// flips to unhealthy once shutdown begins, so an upstream LB stops routing
+// traffic in.
+func TestFrontendHealthHandler(t *testing.T) {
+	defer shuttingDown.Store(false)
+
+	req, _ := http.NewRequest("GET", "/health", nil)
+
+	rr := httptest.NewRecorder()
+	frontendHealthHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	shuttingDown.Store(true)
+	rr = httptest.NewRecorder()
+	frontendHealthHandler(rr, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+// TestForwardStreamsBeforeUpstreamCompletes tests that forward() streams
+// bytes to the client as they arrive (flushing every streamFlushBytes),
+// instead of buffering the whole response, and that the traffic counter
+// ends up matching the total size once the slow upstream finishes.
+func TestForwardStreamsBeforeUpstreamCompletes(t *testing.T) {
+	oldTransport := httpTransport
+	defer func() { httpTransport = oldTransport }()
+	httpTransport = http.DefaultTransport
+
+	const chunkCount = 5
+	chunk := strings.Repeat("x", streamFlushBytes)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		for i := 0; i < chunkCount; i++ {
+			w.Write([]byte(chunk))
+			flusher.Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	dst := strings.TrimPrefix(upstream.URL, "http://")
+	resetBreakers()
+	mu.Lock()
+	traffic[dst] = make([]sizeTimestamp, 0)
+	mu.Unlock()
+
+	balancer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		forward(dst, rw, r)
+	}))
+	defer balancer.Close()
+
+	start := time.Now()
+	resp, err := http.Get(balancer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, 1)
+	n, err := resp.Body.Read(buf)
+	firstByteLatency := time.Since(start)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, n)
+	assert.Less(t, firstByteLatency, chunkCount*50*time.Millisecond,
+		"first byte should arrive well before the upstream finishes streaming all chunks")
+
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, chunkCount*len(chunk), n+len(rest))
+
+	mu.Lock()
+	total := 0
+	for _, st := range traffic[dst] {
+		total += st.size
+	}
+	mu.Unlock()
+	assert.Equal(t, chunkCount*len(chunk), total)
+}
+
+// TestWriteForwardResponseStreamsOversizedCompressibleBody checks that a
+// compressible response that exceeds compress-max-bytes is streamed through
+// uncompressed rather than buffered in full, so a large JSON/text body can't
+// be read entirely into memory just because it's a compression candidate.
+func TestWriteForwardResponseStreamsOversizedCompressibleBody(t *testing.T) {
+	oldEnabled, oldMax := *compressEnabled, *compressMaxBytes
+	*compressEnabled = true
+	*compressMaxBytes = 16
+	defer func() { *compressEnabled, *compressMaxBytes = oldEnabled, oldMax }()
+	allowedEncodings = []string{"gzip", "br"}
+
+	body := strings.Repeat("x", 1024)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+
+	rec := httptest.NewRecorder()
+	writeForwardResponse(rec, req, "backend:8080", resp)
+
+	assert.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, body, rec.Body.String())
+}
@@ -5,8 +5,10 @@ import (
 	"math"
 	"net/http"
 	"os"
+	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -84,6 +86,88 @@ func TestBalancer(t *testing.T) {
 	t.Logf("Test Summary: \nNumber of servers: %d\nTotal load processed: %d\nAverage load per server: %d\n", len(serversPool), totalLoad, avgLoad)
 }
 
+// TestGracefulShutdownDrainsInFlightRequests fires a burst of concurrent
+// requests at the balancer, sends it SIGTERM partway through (as the
+// docker-compose orchestrator would on a rolling deploy), and checks that
+// every request that got a response got a 2xx status. Requests that fail
+// without a response are logged, not counted as failures; response bodies
+// are not read, so a response cut off mid-body is not detected.
+func TestGracefulShutdownDrainsInFlightRequests(t *testing.T) {
+	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
+		t.Skip("Integration test is not enabled")
+	}
+
+	const numRequests = 20
+	var wg sync.WaitGroup
+	results := make([]int, numRequests)
+
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := client.Get(fmt.Sprintf("%s/api/v1/some-data", baseAddress))
+			if err != nil {
+				t.Logf("request %d failed: %s", i, err)
+				return
+			}
+			defer resp.Body.Close()
+			results[i] = resp.StatusCode
+		}(i)
+	}
+
+	// Give the burst a moment to actually be in flight before the signal.
+	time.Sleep(50 * time.Millisecond)
+	if err := exec.Command("docker", "kill", "-s", "SIGTERM", "balancer").Run(); err != nil {
+		t.Fatalf("failed to signal balancer container: %s", err)
+	}
+
+	wg.Wait()
+
+	for i, status := range results {
+		if status != 0 && (status < 200 || status >= 300) {
+			t.Errorf("request %d completed with non-2xx status %d instead of being cleanly dropped", i, status)
+		}
+	}
+}
+
+// TestRetryRecoversFromFlakyBackend exercises the balancer's fault-injection
+// hooks: reload a fault map that makes one backend fail 30% of its requests
+// and check that the retry/circuit-breaker path still delivers 2xx to the
+// client for the overwhelming majority of requests.
+func TestRetryRecoversFromFlakyBackend(t *testing.T) {
+	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
+		t.Skip("Integration test is not enabled")
+	}
+
+	reloadReq, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/lb/faults", baseAddress), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.Do(reloadReq); err != nil {
+		t.Fatalf("failed to reload fault config: %s", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	const numRequests = 100
+	failures := 0
+	for i := 0; i < numRequests; i++ {
+		resp, err := client.Get(fmt.Sprintf("%s/api/v1/some-data", baseAddress))
+		if err != nil {
+			failures++
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			failures++
+		}
+	}
+
+	if failures > numRequests/10 {
+		t.Errorf("expected retries to mask a 30%% flaky backend, got %d/%d failed requests", failures, numRequests)
+	}
+}
+
 func BenchmarkBalancer(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		resp, err := client.Get(fmt.Sprintf("%s/api/v1/some-data", baseAddress))